@@ -2,15 +2,16 @@ package main
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/rancher/kontainer-engine/drivers/options"
 	"github.com/rancher/kontainer-engine/types"
+	"github.com/sirupsen/logrus"
 	"github.com/xanzy/go-cloudstack/cloudstack"
 )
 
 type state struct {
 	ClusterName      string
+	ClusterID        string
 	Description      string
 	InitialNodeCount int64
 
@@ -27,7 +28,36 @@ type AcsSettings struct {
 	TemplateID      string
 	ZoneID          string
 	NetworkID       string
-	UserData        string
+
+	// UserData is the shared inline cloud-init contents (user-data-contents
+	// flag). UserDataPath, when set, is read instead; UserDataRoleOverrides
+	// takes priority over both for the matching role. See renderUserData.
+	UserData              string
+	UserDataPath          string
+	UserDataRoleOverrides map[NodeRole]string
+	UserDataLarge         bool
+
+	// JoinToken and APIServerEndpoint feed the {{.JoinToken}} and
+	// {{.APIServerEndpoint}} user-data template variables so node
+	// bootstrap scripts can join the cluster unattended.
+	JoinToken         string
+	APIServerEndpoint string
+
+	// SSHUser/SSHPrivateKey are used to reach nodes directly over SSH for
+	// out-of-band operations client-go can't do: etcd snapshotting, and
+	// fetching the RKE2 admin kubeconfig in PostCheck.
+	SSHUser           string
+	SSHPrivateKey     string
+	SnapshotRetention int64
+
+	// Tags are operator-supplied key=value pairs merged with the
+	// driver's automatic rancher:* tags on every resource it creates.
+	Tags map[string]string
+
+	// NodePools holds the per-role (etcd/controlplane/worker) topology
+	// used by Create, SetClusterSize and Update to provision and scale
+	// nodes independently of one another.
+	NodePools map[NodeRole]*NodePool
 
 	Config
 }
@@ -76,6 +106,10 @@ func (d *ACSDriver) GetDriverCreateOptions(ctx context.Context) (*types.DriverFl
 		Type:  types.StringType,
 		Usage: "Cluster name to be displayed in Rancher UI",
 	}
+	driverFlag.Options["cluster-id"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Stable cluster identifier for the rancher:cluster-id tag; defaults to cluster-name",
+	}
 	driverFlag.Options["cloudstack-endpoint"] = &types.Flag{
 		Type:  types.StringType,
 		Usage: "Define Cloudstack API endpoint",
@@ -92,6 +126,110 @@ func (d *ACSDriver) GetDriverCreateOptions(ctx context.Context) (*types.DriverFl
 		Type:  types.StringType,
 		Usage: "Description to project",
 	}
+	driverFlag.Options["zone-ids"] = &types.Flag{
+		Type:  types.StringSliceType,
+		Usage: "Zone IDs to spread nodes across; nodes of each role are round-robined over this list, defaults to zone-id",
+	}
+	driverFlag.Options["zone-id"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Cluster-wide fallback zone ID, used when zone-ids isn't set",
+	}
+	driverFlag.Options["service-offering"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Cluster-wide compute offering, used by any role that doesn't set its own *-service-offering",
+	}
+	driverFlag.Options["template-id"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Cluster-wide template/ISO to deploy nodes from, used by any role that doesn't set its own *-template-id",
+	}
+	driverFlag.Options["network-id"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Cluster-wide network ID nodes are attached to",
+	}
+	driverFlag.Options["etcd-node-count"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Number of dedicated etcd nodes",
+		Value: "3",
+	}
+	driverFlag.Options["etcd-service-offering"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Service offering for etcd nodes, defaults to service-offering",
+	}
+	driverFlag.Options["etcd-template-id"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Template for etcd nodes, defaults to template-id",
+	}
+	driverFlag.Options["controlplane-node-count"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Number of control-plane nodes",
+		Value: "3",
+	}
+	driverFlag.Options["controlplane-service-offering"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Service offering for control-plane nodes, defaults to service-offering",
+	}
+	driverFlag.Options["controlplane-template-id"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Template for control-plane nodes, defaults to template-id",
+	}
+	driverFlag.Options["worker-node-count"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Number of worker nodes",
+	}
+	driverFlag.Options["worker-service-offering"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Service offering for worker nodes, defaults to service-offering",
+	}
+	driverFlag.Options["worker-template-id"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Template for worker nodes, defaults to template-id",
+	}
+	driverFlag.Options["user-data-path"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Path to a cloud-init user-data file, shared by every role unless overridden",
+	}
+	driverFlag.Options["user-data-contents"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Inline cloud-init user-data, used when user-data-path isn't set",
+	}
+	driverFlag.Options["user-data-role-overrides"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: `JSON object mapping role to cloud-init user-data, e.g. {"worker": "..."}, taking priority over user-data-path/user-data-contents for that role`,
+	}
+	driverFlag.Options["user-data-large"] = &types.Flag{
+		Type:  types.BoolType,
+		Usage: "Set if this CloudStack deployment has the extended (1MB) user-data limit enabled; otherwise the classic 32KB limit is enforced",
+	}
+	driverFlag.Options["join-token"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Token nodes use to join the cluster, templated into user-data as {{.JoinToken}}; generated automatically if left blank",
+	}
+	driverFlag.Options["api-server-endpoint"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Kubernetes API server endpoint, templated into user-data as {{.APIServerEndpoint}}",
+	}
+	driverFlag.Options["ssh-user"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "SSH user for out-of-band node access (etcd snapshot save/restore, PostCheck's admin kubeconfig fetch)",
+		Value: "rancher",
+	}
+	driverFlag.Options["ssh-private-key-path"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Path to the SSH private key matching ssh-key-pair, used for etcd snapshot save/restore and PostCheck's admin kubeconfig fetch",
+	}
+	driverFlag.Options["ssh-private-key-contents"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Inline SSH private key, used when ssh-private-key-path isn't set",
+	}
+	driverFlag.Options["snapshot-retention"] = &types.Flag{
+		Type:  types.IntType,
+		Usage: "Number of etcd snapshots to keep; older ones are pruned after each ETCDSave",
+		Value: "5",
+	}
+	driverFlag.Options["tags"] = &types.Flag{
+		Type:  types.StringSliceType,
+		Usage: "Repeatable key=value tags applied to every CloudStack resource the driver creates, alongside the automatic rancher:* tags",
+	}
 
 	return &driverFlag, nil
 }
@@ -105,6 +243,10 @@ func (d *ACSDriver) GetDriverUpdateOptions(ctx context.Context) (*types.DriverFl
 		Type:  types.IntType,
 		Usage: "Number of nodes",
 	}
+	driverFlag.Options["description"] = &types.Flag{
+		Type:  types.StringType,
+		Usage: "Description to project",
+	}
 	return &driverFlag, nil
 }
 
@@ -117,6 +259,13 @@ func (d *ACSDriver) Create(ctx context.Context, opts *types.DriverOptions, _ *ty
 
 	info := &types.ClusterInfo{}
 
+	if state.AcsSettings.JoinToken == "" {
+		state.AcsSettings.JoinToken, err = generateJoinToken()
+		if err != nil {
+			return info, err
+		}
+	}
+
 	/*
 		Create two Projects in Cloudstack:
 		First: Contains ETCD and Master elements, this project have a minimum 3 networks to HA,
@@ -139,15 +288,31 @@ func (d *ACSDriver) Create(ctx context.Context, opts *types.DriverOptions, _ *ty
 
 	*/
 
-	// Create instance in Cloudstack
-	_, err = state.AcsSettings.createInstance(state)
+	// Provision the etcd, control-plane and worker pools, spreading each
+	// role's nodes across the configured zones/affinity groups.
+	records, err := state.AcsSettings.createNodePools(ctx, state)
 	if err != nil {
 		return info, err
 	}
 
+	if err := saveClusterState(info, state, records); err != nil {
+		return info, err
+	}
+
+	logProgress(ctx, "cluster %s created with %d node(s)", state.ClusterName, len(records))
+
 	return info, nil
 }
 
+// logProgress writes a driver progress line through logrus, which writes
+// to stderr. Rancher collects the driver process's log output into the
+// cluster's provisioning log, so this is what shows up as "creating 3
+// etcd node(s) for cluster ...", "controlplane pool ready (3 node(s))",
+// etc. in the UI while Create/Remove/SetClusterSize are running.
+func logProgress(ctx context.Context, format string, args ...interface{}) {
+	logrus.Infof(format, args...)
+}
+
 func getStateFromOpts(driverOptions *types.DriverOptions) (state, error) {
 
 	d := state{
@@ -157,11 +322,48 @@ func getStateFromOpts(driverOptions *types.DriverOptions) (state, error) {
 	}
 
 	d.ClusterName = options.GetValueFromDriverOptions(driverOptions, types.StringType, "cluster-name", "ClusterName").(string)
+	d.ClusterID = options.GetValueFromDriverOptions(driverOptions, types.StringType, "cluster-id").(string)
+	if d.ClusterID == "" {
+		d.ClusterID = d.ClusterName
+	}
 	d.Description = options.GetValueFromDriverOptions(driverOptions, types.StringType, "description", "Description").(string)
 	d.AcsSettings.EndPoint = options.GetValueFromDriverOptions(driverOptions, types.StringType, "cloudstack-endpoint", "CloudstackEndPoint").(string)
 	d.AcsSettings.Access = options.GetValueFromDriverOptions(driverOptions, types.StringType, "cloudstack-access").(string)
 	d.AcsSettings.Secret = options.GetValueFromDriverOptions(driverOptions, types.StringType, "cloudstack-secret").(string)
 	d.InitialNodeCount = options.GetValueFromDriverOptions(driverOptions, types.IntType, "node-count", "InitialNodeCount").(int64)
+	d.AcsSettings.ZoneID = options.GetValueFromDriverOptions(driverOptions, types.StringType, "zone-id").(string)
+	d.AcsSettings.ServiceOffering = options.GetValueFromDriverOptions(driverOptions, types.StringType, "service-offering").(string)
+	d.AcsSettings.TemplateID = options.GetValueFromDriverOptions(driverOptions, types.StringType, "template-id").(string)
+	d.AcsSettings.NetworkID = options.GetValueFromDriverOptions(driverOptions, types.StringType, "network-id").(string)
+	d.AcsSettings.NodePools = getNodePoolsFromOpts(driverOptions, d.InitialNodeCount)
+
+	userData, err := getUserDataFromOpts(driverOptions)
+	if err != nil {
+		return d, err
+	}
+	d.AcsSettings.UserData = userData.UserData
+	d.AcsSettings.UserDataPath = userData.UserDataPath
+	d.AcsSettings.UserDataRoleOverrides = userData.UserDataRoleOverrides
+	d.AcsSettings.UserDataLarge = userData.UserDataLarge
+	d.AcsSettings.JoinToken = userData.JoinToken
+	d.AcsSettings.APIServerEndpoint = userData.APIServerEndpoint
+
+	d.AcsSettings.SSHUser = options.GetValueFromDriverOptions(driverOptions, types.StringType, "ssh-user").(string)
+	sshPrivateKey, err := resolvePathOrInline(
+		options.GetValueFromDriverOptions(driverOptions, types.StringType, "ssh-private-key-path").(string),
+		options.GetValueFromDriverOptions(driverOptions, types.StringType, "ssh-private-key-contents").(string),
+	)
+	if err != nil {
+		return d, err
+	}
+	d.AcsSettings.SSHPrivateKey = sshPrivateKey
+	d.AcsSettings.SnapshotRetention = options.GetValueFromDriverOptions(driverOptions, types.IntType, "snapshot-retention").(int64)
+
+	tags, err := parseTags(options.GetValueFromDriverOptions(driverOptions, types.StringSliceType, "tags").(*types.StringSlice).Value)
+	if err != nil {
+		return d, err
+	}
+	d.AcsSettings.Tags = tags
 
 	return d, nil
 }
@@ -187,56 +389,11 @@ func (c *AcsSettings) createProject(s state) (*cloudstack.CreateProjectResponse,
 	return p, nil
 }
 
-func (c *AcsSettings) createInstance(s state) (*cloudstack.DeployVirtualMachineResponse, error) {
-
-	cs, err := c.acsConn()
-	if err != nil {
-		//fmt.Errorf("Failed to connect to cloudstack")
-		return nil, err
-	}
-
-	p := cs.VirtualMachine.NewDeployVirtualMachineParams(c.ServiceOffering, c.TemplateID, c.ZoneID)
-
-	p.SetDisplayname(s.ClusterName)
-
-	//TODO: Get auto attributes
-	p.SetName(s.ClusterName)
-	p.SetNetworkids([]string{c.NetworkID})
-	p.SetProjectid(c.ProjectID)
-	p.SetServiceofferingid(c.ServiceOffering)
-	p.SetTemplateid(c.TemplateID)
-	p.SetZoneid(c.ZoneID)
-
-	vm, err := cs.VirtualMachine.DeployVirtualMachine(p)
-	if err != nil {
-		fmt.Printf("Error creating the new instance: %s\n", err)
-	} else {
-		fmt.Printf("Success create instances")
-	}
-
-	return vm, nil
-}
-
 func (c *AcsSettings) acsConn() (*cloudstack.CloudStackClient, error) {
 	cloudstackConnection := cloudstack.NewClient(c.EndPoint, c.Access, c.Secret, false)
 	return cloudstackConnection, nil
 }
 
-// Update Will be update infra
-func (d *ACSDriver) Update(ctx context.Context, info *types.ClusterInfo, opts *types.DriverOptions) (*types.ClusterInfo, error) {
-	return info, nil
-}
-
-// PostCheck confirm settings after create
-func (d *ACSDriver) PostCheck(ctx context.Context, info *types.ClusterInfo) (*types.ClusterInfo, error) {
-	return info, nil
-}
-
-// Remove delete provider cluster
-func (d *ACSDriver) Remove(ctx context.Context, info *types.ClusterInfo) error {
-	return fmt.Errorf("Not implemented")
-}
-
 // GetVersion - d√£
 func (d *ACSDriver) GetVersion(ctx context.Context, info *types.ClusterInfo) (*types.KubernetesVersion, error) {
 	k8s := &types.KubernetesVersion{}
@@ -254,37 +411,12 @@ func (d *ACSDriver) GetClusterSize(ctx context.Context, info *types.ClusterInfo)
 	return count, nil
 }
 
-// SetClusterSize setup the cluster size
-func (d *ACSDriver) SetClusterSize(ctx context.Context, info *types.ClusterInfo, count *types.NodeCount) error {
-	return fmt.Errorf("Not implemented")
-}
-
 // GetCapabilities Get information about k8s
 func (d *ACSDriver) GetCapabilities(ctx context.Context) (*types.Capabilities, error) {
 	cap := &types.Capabilities{}
 	return cap, nil
 }
 
-// RemoveLegacyServiceAccount Init cleanup
-func (d *ACSDriver) RemoveLegacyServiceAccount(ctx context.Context, info *types.ClusterInfo) error {
-	return nil
-}
-
-// ETCDSave generate backup in ETCD cluster
-func (d *ACSDriver) ETCDSave(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
-	return fmt.Errorf("Not implemented")
-}
-
-// ETCDRestore Implement restore options
-func (d *ACSDriver) ETCDRestore(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
-	return nil
-}
-
-// ETCDRemoveSnapshot Remove snapshot
-func (d *ACSDriver) ETCDRemoveSnapshot(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
-	return fmt.Errorf("Not implemented")
-}
-
 // GetK8SCapabilities check cluster options
 func (d *ACSDriver) GetK8SCapabilities(ctx context.Context, options *types.DriverOptions) (*types.K8SCapabilities, error) {
 	k8s := &types.K8SCapabilities{}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	"golang.org/x/crypto/ssh"
+)
+
+// metadataSnapshotsKey is the ClusterInfo.Metadata key holding the
+// JSON-encoded []etcdSnapshot produced by ETCDSave.
+const metadataSnapshotsKey = "etcd-snapshots"
+
+// etcd data, as written by the RKE2-style user-data this driver
+// templates in createNodePools, lives on the leader's dedicated data
+// disk rather than its root volume. etcdSnapshotDir is a sibling
+// directory on that same mount, so the dump ETCDSave writes is actually
+// included in the CloudStack volume snapshot taken from findDataVolume.
+const (
+	etcdDataDir       = "/var/lib/rancher/rke2/server/db/etcd"
+	etcdCertDir       = "/var/lib/rancher/rke2/server/tls/etcd"
+	etcdSnapshotDir   = "/var/lib/rancher/rke2/server/db/snapshots"
+	etcdRestoreDir    = "/mnt/etcd-restore"
+	etcdctlEndpoint   = "https://127.0.0.1:2379"
+	snapshotVolumeTag = "DATADISK"
+)
+
+// etcdSnapshot is the persisted record of a single ETCDSave call.
+type etcdSnapshot struct {
+	Name       string    `json:"name"`
+	SnapshotID string    `json:"snapshotId"`
+	VolumeID   string    `json:"volumeId"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// ETCDSave generate backup in ETCD cluster
+func (d *ACSDriver) ETCDSave(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
+	settings, records, err := loadClusterState(clusterInfo)
+	if err != nil {
+		return err
+	}
+
+	leader, err := etcdLeader(records)
+	if err != nil {
+		return err
+	}
+
+	cs, err := settings.acsConn()
+	if err != nil {
+		return err
+	}
+
+	dataVolume, err := findDataVolume(cs, leader.ID)
+	if err != nil {
+		return err
+	}
+
+	logProgress(ctx, "saving etcd snapshot %s on %s", snapshotName, leader.ID)
+	snapshotPath := fmt.Sprintf("%s/%s.db", etcdSnapshotDir, snapshotName)
+	if _, err := settings.sshRun(leader.IPAddress, etcdctlSnapshotSaveCommand(snapshotPath)); err != nil {
+		return fmt.Errorf("running etcdctl snapshot save: %v", err)
+	}
+
+	snapParams := cs.Snapshot.NewCreateSnapshotParams(dataVolume.Id)
+	snapResp, err := cs.Snapshot.CreateSnapshot(snapParams)
+	if err != nil {
+		return fmt.Errorf("creating cloudstack snapshot: %v", err)
+	}
+	if _, err := acsjobWaiter(cs).Wait(snapResp.JobID); err != nil {
+		return fmt.Errorf("creating cloudstack snapshot: %v", err)
+	}
+
+	timestamp := time.Now()
+	snapshotTags := settings.mergedTags(clusterInfo.Metadata[metadataClusterNameKey], clusterInfo.Metadata[metadataClusterIDKey], RoleEtcd)
+	snapshotTags["snapshot"] = snapshotName
+	snapshotTags["timestamp"] = timestamp.Format(time.RFC3339)
+	if err := tagResource(cs, snapResp.Id, "Snapshot", snapshotTags); err != nil {
+		return fmt.Errorf("tagging cloudstack snapshot: %v", err)
+	}
+
+	snapshots, err := loadSnapshots(clusterInfo)
+	if err != nil {
+		return err
+	}
+	snapshots = append(snapshots, etcdSnapshot{
+		Name:       snapshotName,
+		SnapshotID: snapResp.Id,
+		VolumeID:   dataVolume.Id,
+		Timestamp:  timestamp,
+	})
+
+	snapshots, pruned, err := pruneSnapshots(cs, snapshots, settings.SnapshotRetention)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		logProgress(ctx, "pruned %d snapshot(s) beyond retention of %d", pruned, settings.SnapshotRetention)
+	}
+
+	return saveSnapshots(clusterInfo, snapshots)
+}
+
+// ETCDRestore restores an etcd snapshot onto the cluster. A plain
+// `etcdctl snapshot restore` only rewrites the one member it runs on - with
+// the rest of the etcd pool still holding their old data and outvoting it,
+// nothing would actually change. RKE2 handles this with
+// `rke2 server --cluster-reset`, which reinitializes the leader as a
+// single-member cluster from the snapshot; every other etcd member then
+// has its data wiped and rejoins that cluster fresh, the same dance
+// RKE2's own restore documentation describes.
+func (d *ACSDriver) ETCDRestore(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
+	settings, records, err := loadClusterState(clusterInfo)
+	if err != nil {
+		return err
+	}
+
+	leader, err := etcdLeader(records)
+	if err != nil {
+		return err
+	}
+	followers := nodeRecordsByRole(records, RoleEtcd)[1:]
+
+	snapshots, err := loadSnapshots(clusterInfo)
+	if err != nil {
+		return err
+	}
+	snapshot, err := findSnapshot(snapshots, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	cs, err := settings.acsConn()
+	if err != nil {
+		return err
+	}
+
+	logProgress(ctx, "restoring etcd snapshot %s onto %s", snapshotName, leader.ID)
+
+	volParams := cs.Volume.NewCreateVolumeParams()
+	volParams.SetSnapshotid(snapshot.SnapshotID)
+	volParams.SetName(fmt.Sprintf("%s-restore", snapshotName))
+	if settings.ProjectID != "" {
+		volParams.SetProjectid(settings.ProjectID)
+	}
+	volResp, err := cs.Volume.CreateVolume(volParams)
+	if err != nil {
+		return fmt.Errorf("creating volume from snapshot %s: %v", snapshotName, err)
+	}
+	if _, err := acsjobWaiter(cs).Wait(volResp.JobID); err != nil {
+		return fmt.Errorf("creating volume from snapshot %s: %v", snapshotName, err)
+	}
+
+	attachParams := cs.Volume.NewAttachVolumeParams(volResp.Id, leader.ID)
+	attachResp, err := cs.Volume.AttachVolume(attachParams)
+	if err != nil {
+		return fmt.Errorf("attaching restored volume to %s: %v", leader.ID, err)
+	}
+	if _, err := acsjobWaiter(cs).Wait(attachResp.JobID); err != nil {
+		return fmt.Errorf("attaching restored volume to %s: %v", leader.ID, err)
+	}
+
+	if _, err := settings.sshRun(leader.IPAddress, mountRestoreVolumeCommand(volResp.Id)); err != nil {
+		return fmt.Errorf("mounting restored volume on %s: %v", leader.ID, err)
+	}
+
+	// rke2 refuses --cluster-reset while its own server is running, so the
+	// leader isn't stopped until everything that can still fail (volume
+	// create/attach/mount) has already succeeded - a failed restore up to
+	// this point leaves the cluster serving on its old data, unchanged.
+	if _, err := settings.sshRun(leader.IPAddress, "systemctl stop rke2-server"); err != nil {
+		return fmt.Errorf("stopping rke2-server on %s: %v", leader.ID, err)
+	}
+
+	// The mounted volume is a clone of the whole data-disk root, so the
+	// dump sits under the same snapshots/ subdirectory ETCDSave wrote it
+	// to (etcdSnapshotDir), not at the mount's root.
+	restorePath := fmt.Sprintf("%s/snapshots/%s.db", etcdRestoreDir, snapshotName)
+	if _, err := settings.sshRun(leader.IPAddress, clusterResetRestoreCommand(restorePath)); err != nil {
+		return fmt.Errorf("running rke2 cluster-reset restore on %s: %v", leader.ID, err)
+	}
+
+	logProgress(ctx, "rejoining %d etcd follower(s) to the restored cluster", len(followers))
+	for _, node := range followers {
+		if _, err := settings.sshRun(node.IPAddress, "systemctl stop rke2-server"); err != nil {
+			return fmt.Errorf("stopping rke2-server on follower %s: %v", node.ID, err)
+		}
+		if _, err := settings.sshRun(node.IPAddress, rejoinEtcdFollowerCommand()); err != nil {
+			return fmt.Errorf("rejoining etcd follower %s: %v", node.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// ETCDRemoveSnapshot Remove snapshot
+func (d *ACSDriver) ETCDRemoveSnapshot(ctx context.Context, clusterInfo *types.ClusterInfo, opts *types.DriverOptions, snapshotName string) error {
+	settings, _, err := loadClusterState(clusterInfo)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := loadSnapshots(clusterInfo)
+	if err != nil {
+		return err
+	}
+	snapshot, err := findSnapshot(snapshots, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	cs, err := settings.acsConn()
+	if err != nil {
+		return err
+	}
+
+	if err := deleteSnapshot(cs, snapshot.SnapshotID); err != nil {
+		return err
+	}
+
+	return saveSnapshots(clusterInfo, removeSnapshot(snapshots, snapshotName))
+}
+
+// tagResource attaches key/value tags to a single CloudStack resource.
+func tagResource(cs *cloudstack.CloudStackClient, resourceID, resourceType string, tags map[string]string) error {
+	p := cs.Resourcetags.NewCreateTagsParams([]string{resourceID}, resourceType, tags)
+	resp, err := cs.Resourcetags.CreateTags(p)
+	if err != nil {
+		return err
+	}
+	_, err = acsjobWaiter(cs).Wait(resp.JobID)
+	return err
+}
+
+func deleteSnapshot(cs *cloudstack.CloudStackClient, snapshotID string) error {
+	p := cs.Snapshot.NewDeleteSnapshotParams(snapshotID)
+	resp, err := cs.Snapshot.DeleteSnapshot(p)
+	if err != nil {
+		return fmt.Errorf("deleting snapshot %s: %v", snapshotID, err)
+	}
+	if _, err := acsjobWaiter(cs).Wait(resp.JobID); err != nil {
+		return fmt.Errorf("deleting snapshot %s: %v", snapshotID, err)
+	}
+	return nil
+}
+
+// pruneSnapshots deletes the oldest snapshots beyond retention, returning
+// the surviving set and how many were removed. retention <= 0 disables
+// pruning.
+func pruneSnapshots(cs *cloudstack.CloudStackClient, snapshots []etcdSnapshot, retention int64) ([]etcdSnapshot, int, error) {
+	if retention <= 0 || int64(len(snapshots)) <= retention {
+		return snapshots, 0, nil
+	}
+
+	sorted := make([]etcdSnapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	toRemove := sorted[:int64(len(sorted))-retention]
+	removed := map[string]bool{}
+	for _, snap := range toRemove {
+		if err := deleteSnapshot(cs, snap.SnapshotID); err != nil {
+			return snapshots, 0, err
+		}
+		removed[snap.Name] = true
+	}
+
+	var kept []etcdSnapshot
+	for _, snap := range snapshots {
+		if !removed[snap.Name] {
+			kept = append(kept, snap)
+		}
+	}
+	return kept, len(toRemove), nil
+}
+
+func etcdLeader(records []NodeRecord) (NodeRecord, error) {
+	etcdNodes := nodeRecordsByRole(records, RoleEtcd)
+	if len(etcdNodes) == 0 {
+		return NodeRecord{}, fmt.Errorf("cluster has no etcd nodes")
+	}
+	return etcdNodes[0], nil
+}
+
+func findDataVolume(cs *cloudstack.CloudStackClient, vmID string) (*cloudstack.Volume, error) {
+	p := cs.Volume.NewListVolumesParams()
+	p.SetVirtualmachineid(vmID)
+	p.SetType(snapshotVolumeTag)
+
+	resp, err := cs.Volume.ListVolumes(p)
+	if err != nil {
+		return nil, fmt.Errorf("listing data volumes for %s: %v", vmID, err)
+	}
+	if len(resp.Volumes) == 0 {
+		return nil, fmt.Errorf("node %s has no attached data disk for etcd snapshots", vmID)
+	}
+	return resp.Volumes[0], nil
+}
+
+func loadSnapshots(info *types.ClusterInfo) ([]etcdSnapshot, error) {
+	raw, ok := info.Metadata[metadataSnapshotsKey]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+	var snapshots []etcdSnapshot
+	if err := json.Unmarshal([]byte(raw), &snapshots); err != nil {
+		return nil, fmt.Errorf("decoding etcd snapshots: %v", err)
+	}
+	return snapshots, nil
+}
+
+func saveSnapshots(info *types.ClusterInfo, snapshots []etcdSnapshot) error {
+	b, err := json.Marshal(snapshots)
+	if err != nil {
+		return fmt.Errorf("encoding etcd snapshots: %v", err)
+	}
+	info.Metadata[metadataSnapshotsKey] = string(b)
+	return nil
+}
+
+func findSnapshot(snapshots []etcdSnapshot, name string) (etcdSnapshot, error) {
+	for _, s := range snapshots {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return etcdSnapshot{}, fmt.Errorf("no etcd snapshot named %s", name)
+}
+
+func removeSnapshot(snapshots []etcdSnapshot, name string) []etcdSnapshot {
+	out := make([]etcdSnapshot, 0, len(snapshots))
+	for _, s := range snapshots {
+		if s.Name != name {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func etcdctlSnapshotSaveCommand(snapshotPath string) string {
+	return fmt.Sprintf(
+		"mkdir -p %s && ETCDCTL_API=3 etcdctl snapshot save %s --endpoints=%s --cacert=%s/server-ca.crt --cert=%s/server-client.crt --key=%s/server-client.key",
+		etcdSnapshotDir, snapshotPath, etcdctlEndpoint, etcdCertDir, etcdCertDir, etcdCertDir,
+	)
+}
+
+// clusterResetRestoreCommand reinitializes the (already-stopped) leader as
+// a single-member etcd cluster seeded from snapshotPath, then starts
+// rke2-server again. rke2-server must already be stopped on the leader,
+// which ETCDRestore does immediately before calling this.
+func clusterResetRestoreCommand(snapshotPath string) string {
+	return fmt.Sprintf(
+		"rke2 server --cluster-reset --cluster-reset-restore-path=%s && systemctl start rke2-server",
+		snapshotPath,
+	)
+}
+
+// rejoinEtcdFollowerCommand wipes a follower's stale etcd data (left over
+// from before the leader's cluster-reset) and starts rke2-server, which
+// makes it rejoin the restored cluster as a fresh member.
+func rejoinEtcdFollowerCommand() string {
+	return fmt.Sprintf("rm -rf %s && systemctl start rke2-server", etcdDataDir)
+}
+
+// mountRestoreVolumeCommand mounts the CloudStack data volume just
+// attached to the leader at etcdRestoreDir. CloudStack's KVM driver sets
+// each virtio disk's serial number to the volume's UUID (dashes removed,
+// truncated to 20 characters), which udev exposes under /dev/disk/by-id/virtio-<serial>,
+// so the newly attached volume can be found without guessing device
+// ordering.
+func mountRestoreVolumeCommand(volumeID string) string {
+	serial := strings.ReplaceAll(volumeID, "-", "")
+	if len(serial) > 20 {
+		serial = serial[:20]
+	}
+	device := fmt.Sprintf("/dev/disk/by-id/virtio-%s", serial)
+	return fmt.Sprintf("mkdir -p %s && mount %s %s", etcdRestoreDir, device, etcdRestoreDir)
+}
+
+// sshRun executes command on host over SSH using the driver's configured
+// SSHUser/SSHPrivateKey, returning combined stdout.
+func (c *AcsSettings) sshRun(host string, command string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("no IP address recorded for target node")
+	}
+	if c.SSHPrivateKey == "" {
+		return "", fmt.Errorf("ssh-private-key-path or ssh-private-key-contents must be set for SSH node access (etcd snapshots, PostCheck)")
+	}
+
+	signer, err := ssh.ParsePrivateKey([]byte(c.SSHPrivateKey))
+	if err != nil {
+		return "", fmt.Errorf("parsing ssh private key: %v", err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            c.SSHUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
+	}
+
+	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:22", host), config)
+	if err != nil {
+		return "", fmt.Errorf("dialing %s: %v", host, err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("opening ssh session to %s: %v", host, err)
+	}
+	defer session.Close()
+
+	var output bytes.Buffer
+	session.Stdout = &output
+	session.Stderr = &output
+
+	if err := session.Run(command); err != nil {
+		return output.String(), fmt.Errorf("command failed on %s: %v (output: %s)", host, err, output.String())
+	}
+
+	return output.String(), nil
+}
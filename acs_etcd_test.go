@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneSnapshotsRetentionDisabled(t *testing.T) {
+	snapshots := []etcdSnapshot{
+		{Name: "a", Timestamp: time.Unix(1, 0)},
+		{Name: "b", Timestamp: time.Unix(2, 0)},
+	}
+
+	// retention <= 0 disables pruning and must return before touching cs,
+	// so a nil client is safe to pass here.
+	kept, pruned, err := pruneSnapshots(nil, snapshots, 0)
+	if err != nil {
+		t.Fatalf("pruneSnapshots returned unexpected error: %v", err)
+	}
+	if pruned != 0 || len(kept) != len(snapshots) {
+		t.Fatalf("pruneSnapshots(retention=0) = (%v, %d), want all %d snapshots kept and 0 pruned", kept, pruned, len(snapshots))
+	}
+}
+
+func TestPruneSnapshotsUnderRetention(t *testing.T) {
+	snapshots := []etcdSnapshot{
+		{Name: "a", Timestamp: time.Unix(1, 0)},
+		{Name: "b", Timestamp: time.Unix(2, 0)},
+	}
+
+	// len(snapshots) <= retention also returns before touching cs.
+	kept, pruned, err := pruneSnapshots(nil, snapshots, 5)
+	if err != nil {
+		t.Fatalf("pruneSnapshots returned unexpected error: %v", err)
+	}
+	if pruned != 0 || len(kept) != len(snapshots) {
+		t.Fatalf("pruneSnapshots(retention=5) = (%v, %d), want all %d snapshots kept and 0 pruned", kept, pruned, len(snapshots))
+	}
+}
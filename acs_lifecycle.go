@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Dougoc/kontainer-engine-driver-cloudstack/acsjob"
+	"github.com/rancher/kontainer-engine/drivers/options"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+)
+
+// acsjobWaiter returns a Waiter preconfigured with the package defaults,
+// shared by every lifecycle call that issues an async CloudStack command.
+func acsjobWaiter(cs *cloudstack.CloudStackClient) *acsjob.Waiter {
+	return acsjob.New(cs)
+}
+
+// metadataSettingsKey stores the JSON-encoded AcsSettings a cluster was
+// created with, so driver calls that only receive *types.ClusterInfo
+// (Remove, SetClusterSize, PostCheck, ...) can rebuild a CloudStack
+// client and know each role's ServiceOffering/TemplateID/ZoneIDs without
+// the caller having to pass them again.
+const metadataSettingsKey = "acs-settings"
+
+// metadataDescriptionKey mirrors state.Description into ClusterInfo so
+// Update can tell whether the operator changed it.
+const metadataDescriptionKey = "description"
+
+// metadataClusterNameKey mirrors state.ClusterName into ClusterInfo so
+// calls that only receive *types.ClusterInfo can still name new nodes
+// consistently with the ones Create deployed.
+const metadataClusterNameKey = "cluster-name"
+
+// metadataClusterIDKey mirrors state.ClusterID into ClusterInfo, for the
+// same reason as metadataClusterNameKey.
+const metadataClusterIDKey = "cluster-id"
+
+// saveClusterState persists everything Remove/SetClusterSize/Update need
+// to operate on an already-created cluster: the settings used to reach
+// CloudStack and the node records Create produced.
+func saveClusterState(info *types.ClusterInfo, s state, records []NodeRecord) error {
+	settingsJSON, err := json.Marshal(s.AcsSettings)
+	if err != nil {
+		return fmt.Errorf("marshaling cluster settings: %v", err)
+	}
+	nodePoolsJSON, err := marshalNodeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	if info.Metadata == nil {
+		info.Metadata = map[string]string{}
+	}
+	info.Metadata[metadataSettingsKey] = string(settingsJSON)
+	info.Metadata[metadataNodePoolsKey] = nodePoolsJSON
+	info.Metadata[metadataDescriptionKey] = s.Description
+	info.Metadata[metadataClusterNameKey] = s.ClusterName
+	info.Metadata[metadataClusterIDKey] = s.ClusterID
+	info.NodeCount = int64(len(records))
+
+	return nil
+}
+
+// loadClusterState is the inverse of saveClusterState.
+func loadClusterState(info *types.ClusterInfo) (AcsSettings, []NodeRecord, error) {
+	var settings AcsSettings
+
+	raw, ok := info.Metadata[metadataSettingsKey]
+	if !ok {
+		return settings, nil, fmt.Errorf("cluster metadata is missing %q, can't reach CloudStack", metadataSettingsKey)
+	}
+	if err := json.Unmarshal([]byte(raw), &settings); err != nil {
+		return settings, nil, fmt.Errorf("decoding cluster settings: %v", err)
+	}
+
+	records, err := unmarshalNodeRecords(info.Metadata[metadataNodePoolsKey])
+	if err != nil {
+		return settings, nil, fmt.Errorf("decoding node records: %v", err)
+	}
+
+	return settings, records, nil
+}
+
+// Remove destroys every VM recorded for the cluster, then expunges their
+// volumes and any project/network the driver itself created.
+func (d *ACSDriver) Remove(ctx context.Context, info *types.ClusterInfo) error {
+	// Best-effort: the SA/CRB/namespace only matter while the API server
+	// is still reachable, so a failure here shouldn't stop the VMs it
+	// granted access to from being destroyed.
+	_ = d.RemoveLegacyServiceAccount(ctx, info)
+
+	settings, records, err := loadClusterState(info)
+	if err != nil {
+		return err
+	}
+
+	cs, err := settings.acsConn()
+	if err != nil {
+		return err
+	}
+
+	// Tagged VMs the node records don't list (missing or incomplete
+	// metadata) are destroyed along with the recorded ones.
+	clusterName := info.Metadata[metadataClusterNameKey]
+	tagged, err := discoverRecordsByTag(cs, clusterName)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, r := range records {
+		known[r.ID] = true
+	}
+	for _, r := range tagged {
+		if !known[r.ID] {
+			logProgress(ctx, "node %s is tagged rancher:cluster-name=%s but missing from cluster metadata", r.ID, clusterName)
+			records = append(records, r)
+		}
+	}
+
+	waiter := acsjobWaiter(cs)
+
+	for _, record := range records {
+		logProgress(ctx, "destroying %s node %s", record.Role, record.ID)
+
+		p := cs.VirtualMachine.NewDestroyVirtualMachineParams(record.ID)
+		p.SetExpunge(true)
+
+		resp, err := cs.VirtualMachine.DestroyVirtualMachine(p)
+		if err != nil {
+			return fmt.Errorf("destroying node %s: %v", record.ID, err)
+		}
+		if _, err := waiter.Wait(resp.JobID); err != nil {
+			return fmt.Errorf("destroying node %s: %v", record.ID, err)
+		}
+	}
+
+	if createdNetworkID, ok := info.Metadata["created-network-id"]; ok && createdNetworkID != "" {
+		logProgress(ctx, "deleting network %s", createdNetworkID)
+		p := cs.Network.NewDeleteNetworkParams(createdNetworkID)
+		resp, err := cs.Network.DeleteNetwork(p)
+		if err != nil {
+			return fmt.Errorf("deleting network %s: %v", createdNetworkID, err)
+		}
+		if _, err := waiter.Wait(resp.JobID); err != nil {
+			return fmt.Errorf("deleting network %s: %v", createdNetworkID, err)
+		}
+	}
+
+	if createdProjectID, ok := info.Metadata["created-project-id"]; ok && createdProjectID != "" {
+		logProgress(ctx, "deleting project %s", createdProjectID)
+		p := cs.Project.NewDeleteProjectParams(createdProjectID)
+		if _, err := cs.Project.DeleteProject(p); err != nil {
+			return fmt.Errorf("deleting project %s: %v", createdProjectID, err)
+		}
+	}
+
+	return nil
+}
+
+// SetClusterSize scales the worker pool up or down to count.Count,
+// deploying or destroying the difference and updating the persisted
+// node records accordingly. Only the worker pool is elastic; etcd and
+// control-plane sizes are fixed at creation time.
+func (d *ACSDriver) SetClusterSize(ctx context.Context, info *types.ClusterInfo, count *types.NodeCount) error {
+	settings, records, err := loadClusterState(info)
+	if err != nil {
+		return err
+	}
+
+	workers := nodeRecordsByRole(records, RoleWorker)
+	delta := count.Count - int64(len(workers))
+
+	switch {
+	case delta == 0:
+		return nil
+
+	case delta > 0:
+		pool := settings.NodePools[RoleWorker]
+		if pool == nil {
+			return fmt.Errorf("cluster has no worker pool configuration to scale up from")
+		}
+		zoneIDs := pool.ZoneIDs
+		if len(zoneIDs) == 0 {
+			zoneIDs = []string{settings.ZoneID}
+		}
+
+		cs, err := settings.acsConn()
+		if err != nil {
+			return err
+		}
+
+		s := state{
+			ClusterName: info.Metadata[metadataClusterNameKey],
+			ClusterID:   info.Metadata[metadataClusterIDKey],
+			AcsSettings: settings,
+		}
+
+		logProgress(ctx, "scaling worker pool up by %d node(s)", delta)
+		for i := int64(0); i < delta; i++ {
+			zoneID := zoneIDs[(int64(len(workers))+i)%int64(len(zoneIDs))]
+			record, err := settings.deployPoolNode(cs, s, pool, zoneID, int64(len(workers))+i)
+			if err != nil {
+				return fmt.Errorf("deploying worker node: %v", err)
+			}
+			records = append(records, record)
+		}
+
+	case delta < 0:
+		cs, err := settings.acsConn()
+		if err != nil {
+			return err
+		}
+		waiter := acsjobWaiter(cs)
+
+		toRemove := workers[len(workers)+int(delta):]
+		logProgress(ctx, "scaling worker pool down by %d node(s)", -delta)
+		for _, record := range toRemove {
+			p := cs.VirtualMachine.NewDestroyVirtualMachineParams(record.ID)
+			p.SetExpunge(true)
+			resp, err := cs.VirtualMachine.DestroyVirtualMachine(p)
+			if err != nil {
+				return fmt.Errorf("destroying worker node %s: %v", record.ID, err)
+			}
+			if _, err := waiter.Wait(resp.JobID); err != nil {
+				return fmt.Errorf("destroying worker node %s: %v", record.ID, err)
+			}
+			records = removeNodeRecord(records, record.ID)
+		}
+	}
+
+	nodePoolsJSON, err := marshalNodeRecords(records)
+	if err != nil {
+		return err
+	}
+	info.Metadata[metadataNodePoolsKey] = nodePoolsJSON
+	info.NodeCount = int64(len(records))
+
+	return nil
+}
+
+// removeNodeRecord returns records with the entry matching id dropped.
+func removeNodeRecord(records []NodeRecord, id string) []NodeRecord {
+	out := make([]NodeRecord, 0, len(records))
+	for _, r := range records {
+		if r.ID != id {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Update re-reads the mutable driver options - today just worker
+// node-count and description - and re-drives SetClusterSize to reach the
+// requested state.
+func (d *ACSDriver) Update(ctx context.Context, info *types.ClusterInfo, opts *types.DriverOptions) (*types.ClusterInfo, error) {
+	// GetValueFromDriverOptions returns 0 when node-count wasn't supplied,
+	// which is indistinguishable from an explicit "scale to zero" - check
+	// the raw option maps so a description-only Update doesn't drive
+	// SetClusterSize(0) and tear down every worker node.
+	_, setByName := opts.IntOptions["node-count"]
+	_, setByField := opts.IntOptions["InitialNodeCount"]
+	if setByName || setByField {
+		nodeCount := options.GetValueFromDriverOptions(opts, types.IntType, "node-count", "InitialNodeCount").(int64)
+		if err := d.SetClusterSize(ctx, info, &types.NodeCount{Count: nodeCount}); err != nil {
+			return info, err
+		}
+	}
+
+	if description := options.GetValueFromDriverOptions(opts, types.StringType, "description", "Description").(string); description != "" {
+		info.Metadata[metadataDescriptionKey] = description
+	}
+
+	return info, nil
+}
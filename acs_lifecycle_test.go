@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rancher/kontainer-engine/types"
+)
+
+// TestSetClusterSizeNoOpOnMatchingCount exercises the delta == 0 guard:
+// requesting the worker count the cluster already has must be a no-op
+// that neither touches CloudStack nor rewrites the persisted node records,
+// so an Update that resubmits the current node-count resizes nothing.
+func TestSetClusterSizeNoOpOnMatchingCount(t *testing.T) {
+	records := []NodeRecord{
+		{ID: "worker-1", Role: RoleWorker},
+		{ID: "worker-2", Role: RoleWorker},
+	}
+	nodePoolsJSON, err := marshalNodeRecords(records)
+	if err != nil {
+		t.Fatalf("marshalNodeRecords returned unexpected error: %v", err)
+	}
+	settingsJSON, err := json.Marshal(AcsSettings{})
+	if err != nil {
+		t.Fatalf("json.Marshal(AcsSettings{}) returned unexpected error: %v", err)
+	}
+
+	info := &types.ClusterInfo{
+		Metadata: map[string]string{
+			metadataSettingsKey:  string(settingsJSON),
+			metadataNodePoolsKey: nodePoolsJSON,
+		},
+		NodeCount: int64(len(records)),
+	}
+
+	d := &ACSDriver{}
+	if err := d.SetClusterSize(context.Background(), info, &types.NodeCount{Count: int64(len(records))}); err != nil {
+		t.Fatalf("SetClusterSize returned unexpected error: %v", err)
+	}
+
+	if info.Metadata[metadataNodePoolsKey] != nodePoolsJSON {
+		t.Fatalf("SetClusterSize with matching count rewrote node records, want them untouched")
+	}
+}
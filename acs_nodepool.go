@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Dougoc/kontainer-engine-driver-cloudstack/acsjob"
+	"github.com/rancher/kontainer-engine/drivers/options"
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/sirupsen/logrus"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+)
+
+// NodeRole identifies the function a node plays inside the cluster.
+type NodeRole string
+
+const (
+	// RoleEtcd - dedicated etcd member
+	RoleEtcd NodeRole = "etcd"
+	// RoleControlPlane - kubernetes control-plane member
+	RoleControlPlane NodeRole = "controlplane"
+	// RoleWorker - kubernetes worker
+	RoleWorker NodeRole = "worker"
+)
+
+// metadataNodePoolsKey is the ClusterInfo.Metadata key under which the
+// JSON-encoded []NodeRecord produced by Create is stored, so Update,
+// SetClusterSize and Remove can operate per-pool without re-deriving
+// topology from scratch.
+const metadataNodePoolsKey = "node-pools"
+
+// NodePool describes how a single role should be provisioned: how many
+// nodes, on what compute/template, and across which zones/networks it
+// should be spread.
+type NodePool struct {
+	Role            NodeRole
+	Count           int64
+	ServiceOffering string
+	TemplateID      string
+	ZoneIDs         []string
+	NetworkIDs      []string
+	DiskOffering    string
+	Affinity        string
+}
+
+// NodeRecord is the persisted representation of a single deployed VM,
+// kept in ClusterInfo.Metadata so later driver calls can find it again.
+type NodeRecord struct {
+	ID              string   `json:"id"`
+	Role            NodeRole `json:"role"`
+	ZoneID          string   `json:"zoneId"`
+	NetworkIDs      []string `json:"networkIds"`
+	AffinityGroupID string   `json:"affinityGroupId"`
+	IPAddress       string   `json:"ipAddress"`
+}
+
+// getNodePoolsFromOpts builds the per-role pools Create provisions.
+// worker-node-count has no default of its own, so a cluster created the
+// standard Rancher way - node-count set, worker-node-count left unset -
+// would otherwise provision zero workers; initialNodeCount (node-count)
+// is used as the worker pool's fallback so Create and SetClusterSize/
+// Update, which key the worker count off node-count, agree on a size.
+func getNodePoolsFromOpts(driverOptions *types.DriverOptions, initialNodeCount int64) map[NodeRole]*NodePool {
+	zoneIDs := options.GetValueFromDriverOptions(driverOptions, types.StringSliceType, "zone-ids").(*types.StringSlice).Value
+
+	workerCount := options.GetValueFromDriverOptions(driverOptions, types.IntType, "worker-node-count").(int64)
+	if _, set := driverOptions.IntOptions["worker-node-count"]; !set {
+		workerCount = initialNodeCount
+	}
+
+	pools := map[NodeRole]*NodePool{
+		RoleEtcd: {
+			Role:            RoleEtcd,
+			Count:           options.GetValueFromDriverOptions(driverOptions, types.IntType, "etcd-node-count").(int64),
+			ServiceOffering: options.GetValueFromDriverOptions(driverOptions, types.StringType, "etcd-service-offering").(string),
+			TemplateID:      options.GetValueFromDriverOptions(driverOptions, types.StringType, "etcd-template-id").(string),
+			ZoneIDs:         zoneIDs,
+		},
+		RoleControlPlane: {
+			Role:            RoleControlPlane,
+			Count:           options.GetValueFromDriverOptions(driverOptions, types.IntType, "controlplane-node-count").(int64),
+			ServiceOffering: options.GetValueFromDriverOptions(driverOptions, types.StringType, "controlplane-service-offering").(string),
+			TemplateID:      options.GetValueFromDriverOptions(driverOptions, types.StringType, "controlplane-template-id").(string),
+			ZoneIDs:         zoneIDs,
+		},
+		RoleWorker: {
+			Role:            RoleWorker,
+			Count:           workerCount,
+			ServiceOffering: options.GetValueFromDriverOptions(driverOptions, types.StringType, "worker-service-offering").(string),
+			TemplateID:      options.GetValueFromDriverOptions(driverOptions, types.StringType, "worker-template-id").(string),
+			ZoneIDs:         zoneIDs,
+		},
+	}
+
+	return pools
+}
+
+// createNodePools provisions the etcd, control-plane and worker pools
+// described by s.NodePools, round-robining each pool's nodes across its
+// ZoneIDs so that the loss of a single CloudStack zone can't take down a
+// quorum of any one role. Every role gets its own instance-affinity group
+// so its members are also spread across distinct hosts within a zone.
+func (c *AcsSettings) createNodePools(ctx context.Context, s state) ([]NodeRecord, error) {
+	cs, err := c.acsConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []NodeRecord
+	for _, role := range []NodeRole{RoleEtcd, RoleControlPlane, RoleWorker} {
+		pool := c.NodePools[role]
+		if pool == nil || pool.Count == 0 {
+			continue
+		}
+
+		logProgress(ctx, "creating %d %s node(s) for cluster %s", pool.Count, role, s.ClusterName)
+
+		affinityGroupID, err := c.ensureAffinityGroup(cs, s.ClusterName, s.ClusterID, role)
+		if err != nil {
+			return records, fmt.Errorf("creating affinity group for role %s: %v", role, err)
+		}
+		pool.Affinity = affinityGroupID
+
+		zoneIDs := pool.ZoneIDs
+		if len(zoneIDs) == 0 {
+			zoneIDs = []string{c.ZoneID}
+		}
+
+		for i := int64(0); i < pool.Count; i++ {
+			zoneID := zoneIDs[i%int64(len(zoneIDs))]
+
+			record, err := c.deployPoolNode(cs, s, pool, zoneID, i)
+			if err != nil {
+				return records, fmt.Errorf("deploying %s node %d: %v", role, i, err)
+			}
+			records = append(records, record)
+		}
+
+		logProgress(ctx, "%s pool ready (%d node(s))", role, pool.Count)
+	}
+
+	return records, nil
+}
+
+// deployPoolNode deploys a single VM for the given pool/zone pair,
+// falling back to the cluster-wide ServiceOffering/TemplateID/NetworkID
+// when the pool doesn't override them, and blocks until CloudStack's
+// deploy job finishes so a failed deployment is reported as an error
+// instead of a half-populated NodeRecord.
+func (c *AcsSettings) deployPoolNode(cs *cloudstack.CloudStackClient, s state, pool *NodePool, zoneID string, index int64) (NodeRecord, error) {
+	serviceOffering := pool.ServiceOffering
+	if serviceOffering == "" {
+		serviceOffering = c.ServiceOffering
+	}
+	templateID := pool.TemplateID
+	if templateID == "" {
+		templateID = c.TemplateID
+	}
+	networkIDs := pool.NetworkIDs
+	if len(networkIDs) == 0 {
+		networkIDs = []string{c.NetworkID}
+	}
+
+	name := fmt.Sprintf("%s-%s-%d", s.ClusterName, pool.Role, index)
+
+	p := cs.VirtualMachine.NewDeployVirtualMachineParams(serviceOffering, templateID, zoneID)
+	p.SetDisplayname(name)
+	p.SetName(name)
+	p.SetNetworkids(networkIDs)
+	p.SetServiceofferingid(serviceOffering)
+	p.SetTemplateid(templateID)
+	p.SetZoneid(zoneID)
+	if c.ProjectID != "" {
+		p.SetProjectid(c.ProjectID)
+	}
+	if pool.Affinity != "" {
+		p.SetAffinitygroupids([]string{pool.Affinity})
+	}
+
+	userData, err := c.renderUserData(userDataVars{
+		ClusterName:       s.ClusterName,
+		Role:              pool.Role,
+		NodeIndex:         index,
+		ZoneID:            zoneID,
+		JoinToken:         c.JoinToken,
+		APIServerEndpoint: c.APIServerEndpoint,
+	})
+	if err != nil {
+		return NodeRecord{}, err
+	}
+	if userData != "" {
+		p.SetUserdata(userData)
+	}
+
+	vm, err := cs.VirtualMachine.DeployVirtualMachine(p)
+	if err != nil {
+		return NodeRecord{}, err
+	}
+
+	if _, err := acsjob.New(cs).Wait(vm.JobID); err != nil {
+		return NodeRecord{}, err
+	}
+
+	// Tagging is best-effort: the VM is already deployed at this point, so
+	// failing the whole Create over a tagging error would leak it (no
+	// NodeRecord saved, nothing to clean it up). Remove's rancher:*
+	// tag-based discovery is a safety net for exactly this kind of gap,
+	// not the only way a node is found, so a missing tag here is
+	// recoverable rather than fatal.
+	if err := tagResource(cs, vm.Id, "UserVm", buildTags(s, pool.Role)); err != nil {
+		logrus.Warnf("tagging node %s: %v", vm.Id, err)
+	}
+
+	var ipAddress string
+	if len(vm.Nic) > 0 {
+		ipAddress = vm.Nic[0].Ipaddress
+	}
+
+	return NodeRecord{
+		ID:              vm.Id,
+		Role:            pool.Role,
+		ZoneID:          zoneID,
+		NetworkIDs:      networkIDs,
+		AffinityGroupID: pool.Affinity,
+		IPAddress:       ipAddress,
+	}, nil
+}
+
+// ensureAffinityGroup returns the ID of the host-anti-affinity group used
+// to spread every VM of a given role across distinct hypervisors,
+// creating it if it doesn't already exist.
+func (c *AcsSettings) ensureAffinityGroup(cs *cloudstack.CloudStackClient, clusterName, clusterID string, role NodeRole) (string, error) {
+	name := fmt.Sprintf("%s-%s", clusterName, role)
+
+	if existing, count, err := cs.AffinityGroup.GetAffinityGroupByName(name); err == nil && count > 0 {
+		return existing.Id, nil
+	}
+
+	p := cs.AffinityGroup.NewCreateAffinityGroupParams(name, "host anti-affinity")
+	p.SetType("host anti-affinity")
+
+	resp, err := cs.AffinityGroup.CreateAffinityGroup(p)
+	if err != nil {
+		return "", err
+	}
+
+	// AffinityGroup isn't a taggable resourcetype on every CloudStack
+	// version, and losing tags on it isn't worth failing every Create
+	// over, so this is logged rather than returned, the same as the VM
+	// tagging in deployPoolNode.
+	if err := tagResource(cs, resp.Id, "AffinityGroup", c.mergedTags(clusterName, clusterID, role)); err != nil {
+		logrus.Warnf("tagging affinity group %s: %v", resp.Id, err)
+	}
+
+	return resp.Id, nil
+}
+
+func marshalNodeRecords(records []NodeRecord) (string, error) {
+	b, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func unmarshalNodeRecords(raw string) ([]NodeRecord, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var records []NodeRecord
+	if err := json.Unmarshal([]byte(raw), &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ensureAPIServerEndpoint resolves the address PostCheck and node
+// user-data should use to reach the Kubernetes API: an operator-supplied
+// api-server-endpoint, a previously provisioned load balancer VIP, the
+// lone control-plane node's IP, or - for more than one control-plane
+// node - a freshly provisioned CloudStack LB VIP on port 6443 spread
+// across all of them.
+func (c *AcsSettings) ensureAPIServerEndpoint(ctx context.Context, cs *cloudstack.CloudStackClient, info *types.ClusterInfo, controlPlane []NodeRecord) (string, error) {
+	if c.APIServerEndpoint != "" {
+		return c.APIServerEndpoint, nil
+	}
+	if vip := info.Metadata["lb-ip-address"]; vip != "" {
+		return vip, nil
+	}
+
+	if len(controlPlane) == 1 {
+		if controlPlane[0].IPAddress == "" {
+			return "", fmt.Errorf("control-plane node %s has no IP address recorded", controlPlane[0].ID)
+		}
+		return controlPlane[0].IPAddress, nil
+	}
+
+	logProgress(ctx, "provisioning load balancer VIP for %d control-plane node(s)", len(controlPlane))
+	vip, ruleID, err := c.createControlPlaneLB(cs, info.Metadata[metadataClusterNameKey], info.Metadata[metadataClusterIDKey], controlPlane)
+	if err != nil {
+		return "", err
+	}
+
+	info.Metadata["lb-ip-address"] = vip
+	info.Metadata["lb-rule-id"] = ruleID
+	return vip, nil
+}
+
+// createControlPlaneLB associates a new public IP, creates a round-robin
+// load balancer rule on port 6443 and assigns every control-plane node to
+// it, returning the VIP and rule ID to persist.
+func (c *AcsSettings) createControlPlaneLB(cs *cloudstack.CloudStackClient, clusterName, clusterID string, controlPlane []NodeRecord) (vip string, ruleID string, err error) {
+	waiter := acsjob.New(cs)
+
+	assocParams := cs.Address.NewAssociateIpAddressParams()
+	assocParams.SetNetworkid(c.NetworkID)
+	if c.ProjectID != "" {
+		assocParams.SetProjectid(c.ProjectID)
+	}
+	ipResp, err := cs.Address.AssociateIpAddress(assocParams)
+	if err != nil {
+		return "", "", fmt.Errorf("associating load balancer IP: %v", err)
+	}
+	if _, err := waiter.Wait(ipResp.JobID); err != nil {
+		return "", "", fmt.Errorf("associating load balancer IP: %v", err)
+	}
+	if err := tagResource(cs, ipResp.Id, "PublicIpAddress", c.mergedTags(clusterName, clusterID, RoleControlPlane)); err != nil {
+		return "", "", fmt.Errorf("tagging load balancer IP %s: %v", ipResp.Id, err)
+	}
+
+	lbParams := cs.LoadBalancer.NewCreateLoadBalancerRuleParams("roundrobin", "kube-apiserver", 6443, 6443)
+	lbParams.SetPublicipid(ipResp.Id)
+	lbRule, err := cs.LoadBalancer.CreateLoadBalancerRule(lbParams)
+	if err != nil {
+		return "", "", fmt.Errorf("creating load balancer rule: %v", err)
+	}
+
+	vmIDs := make([]string, len(controlPlane))
+	for i, r := range controlPlane {
+		vmIDs[i] = r.ID
+	}
+	assignParams := cs.LoadBalancer.NewAssignToLoadBalancerRuleParams(lbRule.Id)
+	assignParams.SetVirtualmachineids(vmIDs)
+	if _, err := cs.LoadBalancer.AssignToLoadBalancerRule(assignParams); err != nil {
+		return "", "", fmt.Errorf("assigning control-plane nodes to load balancer rule: %v", err)
+	}
+
+	return ipResp.Ipaddress, lbRule.Id, nil
+}
+
+// nodeRecordsByRole filters records down to a single role, preserving order.
+func nodeRecordsByRole(records []NodeRecord, role NodeRole) []NodeRecord {
+	var out []NodeRecord
+	for _, r := range records {
+		if r.Role == role {
+			out = append(out, r)
+		}
+	}
+	return out
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rancher/kontainer-engine/types"
+	"github.com/xanzy/go-cloudstack/cloudstack"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Names of the namespace/ServiceAccount/ClusterRoleBinding PostCheck
+// provisions so Rancher can manage the cluster with a cluster-admin
+// token, mirroring the GKE driver's bootstrap flow.
+const (
+	cattleNamespace         = "cattle-system"
+	serviceAccountName      = "cattle-admin"
+	clusterRoleBindingName  = "cattle-admin-binding"
+	postCheckPollInterval   = 10 * time.Second
+	postCheckDefaultTimeout = 10 * time.Minute
+
+	// rke2AdminKubeconfigPath is where RKE2 writes the cluster-admin
+	// kubeconfig on every control-plane node, pointed at 127.0.0.1 by
+	// default. PostCheck pulls it over SSH to bootstrap the cattle-admin
+	// ServiceAccount instead of talking to the API server anonymously.
+	rke2AdminKubeconfigPath = "/etc/rancher/rke2/rke2.yaml"
+
+	// serviceAccountTokenTTL is how long the cattle-admin token minted via
+	// TokenRequest is valid for. Rancher expects a long-lived credential
+	// to manage the cluster with, not the TokenRequest API's 1 hour
+	// default.
+	serviceAccountTokenTTL = 87600 * time.Hour
+)
+
+// PostCheck waits for the control-plane to come up, resolves the API
+// endpoint, and provisions a cluster-admin ServiceAccount so Rancher can
+// manage the cluster with the returned token.
+func (d *ACSDriver) PostCheck(ctx context.Context, info *types.ClusterInfo) (*types.ClusterInfo, error) {
+	settings, records, err := loadClusterState(info)
+	if err != nil {
+		return info, err
+	}
+
+	cs, err := settings.acsConn()
+	if err != nil {
+		return info, err
+	}
+
+	controlPlane := nodeRecordsByRole(records, RoleControlPlane)
+	if len(controlPlane) == 0 {
+		return info, fmt.Errorf("cluster has no control-plane nodes to check")
+	}
+
+	logProgress(ctx, "waiting for %d control-plane node(s) to report Running", len(controlPlane))
+	if err := waitForVMsRunning(cs, controlPlane, postCheckDefaultTimeout); err != nil {
+		return info, err
+	}
+
+	endpoint, err := settings.ensureAPIServerEndpoint(ctx, cs, info, controlPlane)
+	if err != nil {
+		return info, err
+	}
+
+	logProgress(ctx, "waiting for https://%s:6443/healthz", endpoint)
+	if err := waitForHealthz(endpoint, postCheckDefaultTimeout); err != nil {
+		return info, err
+	}
+
+	clientset, caCert, err := settings.adminClientFor(endpoint, controlPlane[0].IPAddress)
+	if err != nil {
+		return info, err
+	}
+
+	token, err := ensureClusterAdminServiceAccount(ctx, clientset)
+	if err != nil {
+		return info, err
+	}
+
+	serverVersion, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return info, fmt.Errorf("reading kubernetes server version: %v", err)
+	}
+
+	info.Endpoint = fmt.Sprintf("%s:6443", endpoint)
+	info.RootCaCertificate = caCert
+	// Auth is via the cattle-admin ServiceAccount token, not a client
+	// certificate, so there is no ClientCertificate/ClientKey pair to hand
+	// back; leave them empty rather than fabricating one.
+	info.ClientCertificate = ""
+	info.ClientKey = ""
+	info.ServiceAccountToken = token
+	info.Version = serverVersion.GitVersion
+	info.NodeCount = int64(len(records))
+	info.Status = "active"
+
+	return info, nil
+}
+
+// RemoveLegacyServiceAccount garbage-collects the ServiceAccount,
+// ClusterRoleBinding and namespace PostCheck created, best-effort: the
+// cluster is usually mid-teardown by the time this runs, so an
+// unreachable API server is not treated as an error.
+func (d *ACSDriver) RemoveLegacyServiceAccount(ctx context.Context, info *types.ClusterInfo) error {
+	if info.Endpoint == "" || info.ServiceAccountToken == "" {
+		return nil
+	}
+
+	clientset, err := kubernetesClientFor(info.Endpoint, info.ServiceAccountToken, []byte(info.RootCaCertificate))
+	if err != nil {
+		return nil
+	}
+
+	_ = clientset.RbacV1().ClusterRoleBindings().Delete(ctx, clusterRoleBindingName, metav1.DeleteOptions{})
+	_ = clientset.CoreV1().ServiceAccounts(cattleNamespace).Delete(ctx, serviceAccountName, metav1.DeleteOptions{})
+	_ = clientset.CoreV1().Namespaces().Delete(ctx, cattleNamespace, metav1.DeleteOptions{})
+
+	return nil
+}
+
+// adminClientFor builds a cluster-admin client-go clientset for the
+// cluster's API server. The API server is RBAC-enabled, so PostCheck
+// can't bootstrap the cattle-admin ServiceAccount anonymously; instead it
+// pulls RKE2's own admin kubeconfig over the SSH path acs_etcd.go already
+// uses for etcd snapshotting and points it at the resolved endpoint. It
+// also returns the kubeconfig's CA certificate, which RemoveLegacyServiceAccount
+// has no other way to obtain once the cattle-admin token is minted via
+// TokenRequest instead of an auto-created secret.
+func (c *AcsSettings) adminClientFor(endpoint, controlPlaneIP string) (*kubernetes.Clientset, string, error) {
+	raw, err := c.sshRun(controlPlaneIP, fmt.Sprintf("cat %s", rke2AdminKubeconfigPath))
+	if err != nil {
+		return nil, "", fmt.Errorf("reading rke2 admin kubeconfig from %s: %v", controlPlaneIP, err)
+	}
+
+	restConfig, caCert, err := adminRestConfigFromKubeconfig([]byte(raw), endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("building kubernetes client: %v", err)
+	}
+	return clientset, caCert, nil
+}
+
+// adminRestConfigFromKubeconfig parses RKE2's admin kubeconfig and
+// rewrites its cluster server to the resolved API endpoint (RKE2 points
+// it at 127.0.0.1 by default, which is only reachable from the node
+// itself).
+func adminRestConfigFromKubeconfig(raw []byte, endpoint string) (*rest.Config, string, error) {
+	config, err := clientcmd.Load(raw)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing rke2 admin kubeconfig: %v", err)
+	}
+
+	var caCert []byte
+	for name, cluster := range config.Clusters {
+		cluster.Server = fmt.Sprintf("https://%s:6443", endpoint)
+		config.Clusters[name] = cluster
+		caCert = cluster.CertificateAuthorityData
+	}
+
+	restConfig, err := clientcmd.NewDefaultClientConfig(*config, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("building rest config from rke2 admin kubeconfig: %v", err)
+	}
+	return restConfig, string(caCert), nil
+}
+
+// kubernetesClientFor builds a client-go clientset against a bare
+// "host[:port]" endpoint authenticated with a bearer token, used by
+// RemoveLegacyServiceAccount to reconnect with the cattle-admin token
+// PostCheck minted.
+func kubernetesClientFor(endpoint, token string, caData []byte) (*kubernetes.Clientset, error) {
+	host := endpoint
+	if host == "" {
+		return nil, fmt.Errorf("empty api server endpoint")
+	}
+
+	config := &rest.Config{
+		Host:        fmt.Sprintf("https://%s", host),
+		BearerToken: token,
+	}
+	if len(caData) > 0 {
+		config.TLSClientConfig = rest.TLSClientConfig{CAData: caData}
+	} else {
+		config.TLSClientConfig = rest.TLSClientConfig{Insecure: true}
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// waitForVMsRunning polls CloudStack until every node in records reports
+// state "Running" or timeout elapses.
+func waitForVMsRunning(cs *cloudstack.CloudStackClient, records []NodeRecord, timeout time.Duration) error {
+	ids := make([]string, len(records))
+	for i, r := range records {
+		ids[i] = r.ID
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := map[string]bool{}
+		for _, id := range ids {
+			vm, _, err := cs.VirtualMachine.GetVirtualMachineByID(id)
+			if err != nil {
+				return fmt.Errorf("checking state of node %s: %v", id, err)
+			}
+			if vm.State != "Running" {
+				pending[id] = true
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for nodes to reach Running", timeout)
+		}
+		time.Sleep(postCheckPollInterval)
+	}
+}
+
+// waitForHealthz polls https://endpoint:6443/healthz until it returns 200
+// or timeout elapses. The API server's own certificate isn't known yet at
+// this point, so the check only cares that something is listening and
+// answering kubernetes' health endpoint.
+func waitForHealthz(endpoint string, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	url := fmt.Sprintf("https://%s:6443/healthz", endpoint)
+
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			lastErr = fmt.Errorf("unexpected status %d", resp.StatusCode)
+		} else {
+			lastErr = err
+		}
+		time.Sleep(postCheckPollInterval)
+	}
+
+	return fmt.Errorf("timed out after %s waiting for %s: %v", timeout, url, lastErr)
+}
+
+// ensureClusterAdminServiceAccount creates the cattle-system namespace, a
+// cattle-admin ServiceAccount and a cluster-admin ClusterRoleBinding for
+// it, then returns a token for it minted via the TokenRequest API.
+func ensureClusterAdminServiceAccount(ctx context.Context, clientset *kubernetes.Clientset) (token string, err error) {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: cattleNamespace}}
+	if _, err := clientset.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("creating namespace %s: %v", cattleNamespace, err)
+	}
+
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: serviceAccountName, Namespace: cattleNamespace}}
+	if _, err := clientset.CoreV1().ServiceAccounts(cattleNamespace).Create(ctx, sa, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("creating service account %s: %v", serviceAccountName, err)
+	}
+
+	crb := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: clusterRoleBindingName},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "ClusterRole",
+			Name:     "cluster-admin",
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      "ServiceAccount",
+			Name:      serviceAccountName,
+			Namespace: cattleNamespace,
+		}},
+	}
+	if _, err := clientset.RbacV1().ClusterRoleBindings().Create(ctx, crb, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("creating cluster role binding %s: %v", clusterRoleBindingName, err)
+	}
+
+	return mintServiceAccountToken(ctx, clientset, postCheckDefaultTimeout)
+}
+
+// mintServiceAccountToken requests a token for the cattle-admin
+// ServiceAccount via the TokenRequest API. Kubernetes 1.24+ (what this
+// driver's RKE2 nodes run) no longer auto-creates a token Secret for new
+// ServiceAccounts, so TokenRequest is the only way to get one. It's
+// retried for a while in case RBAC hasn't propagated to the API server's
+// authorizer cache yet right after the ClusterRoleBinding was created.
+func mintServiceAccountToken(ctx context.Context, clientset *kubernetes.Clientset, timeout time.Duration) (string, error) {
+	expirationSeconds := int64(serviceAccountTokenTTL.Seconds())
+	tr := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{ExpirationSeconds: &expirationSeconds},
+	}
+
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for {
+		resp, err := clientset.CoreV1().ServiceAccounts(cattleNamespace).CreateToken(ctx, serviceAccountName, tr, metav1.CreateOptions{})
+		if err == nil {
+			return resp.Status.Token, nil
+		}
+		lastErr = err
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out after %s minting a token for %s: %v", timeout, serviceAccountName, lastErr)
+		}
+		time.Sleep(postCheckPollInterval)
+	}
+}
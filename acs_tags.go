@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xanzy/go-cloudstack/cloudstack"
+)
+
+// driverVersion is surfaced as the rancher:driver-version tag so
+// operators can tell which driver build created a given resource.
+const driverVersion = "0.1.0"
+
+// parseTags turns repeatable "key=value" driver flag entries into a map.
+func parseTags(raw []string) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	tags := make(map[string]string, len(raw))
+	for _, entry := range raw {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf(`invalid tag %q, expected "key=value"`, entry)
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// buildTags merges the operator's custom tags with the driver's
+// automatic rancher:* identification tags, which always win on key
+// collisions so a misconfigured custom tag can't defeat the Remove
+// safety net.
+func buildTags(s state, role NodeRole) map[string]string {
+	return s.AcsSettings.mergedTags(s.ClusterName, s.ClusterID, role)
+}
+
+// mergedTags is the AcsSettings-only half of buildTags, for call sites
+// that don't have a full state (e.g. affinity groups and the
+// control-plane load balancer, which are provisioned before/without one).
+func (c *AcsSettings) mergedTags(clusterName, clusterID string, role NodeRole) map[string]string {
+	tags := map[string]string{}
+	for k, v := range c.Tags {
+		tags[k] = v
+	}
+
+	tags["rancher:cluster-name"] = clusterName
+	tags["rancher:cluster-id"] = clusterID
+	tags["rancher:driver-version"] = driverVersion
+	if role != "" {
+		tags["rancher:role"] = string(role)
+	}
+
+	return tags
+}
+
+// discoverRecordsByTag lists every VM tagged rancher:cluster-name for
+// clusterName, used by Remove as a safety net when ClusterInfo.Metadata's
+// node-pools record is missing or incomplete. Resources without the tag
+// are never returned, so Remove can't be tricked into destroying
+// something it didn't create.
+func discoverRecordsByTag(cs *cloudstack.CloudStackClient, clusterName string) ([]NodeRecord, error) {
+	p := cs.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetTags(map[string]string{"rancher:cluster-name": clusterName})
+
+	resp, err := cs.VirtualMachine.ListVirtualMachines(p)
+	if err != nil {
+		return nil, fmt.Errorf("listing tagged virtual machines for %s: %v", clusterName, err)
+	}
+
+	var records []NodeRecord
+	for _, vm := range resp.VirtualMachines {
+		var role NodeRole
+		hasClusterTag := false
+		for _, tag := range vm.Tags {
+			switch tag.Key {
+			case "rancher:cluster-name":
+				hasClusterTag = tag.Value == clusterName
+			case "rancher:role":
+				role = NodeRole(tag.Value)
+			}
+		}
+		if !hasClusterTag {
+			continue
+		}
+
+		var ipAddress string
+		if len(vm.Nic) > 0 {
+			ipAddress = vm.Nic[0].Ipaddress
+		}
+
+		records = append(records, NodeRecord{
+			ID:        vm.Id,
+			Role:      role,
+			ZoneID:    vm.Zoneid,
+			IPAddress: ipAddress,
+		})
+	}
+
+	return records, nil
+}
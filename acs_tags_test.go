@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "empty", raw: nil, want: nil},
+		{
+			name: "single pair",
+			raw:  []string{"env=prod"},
+			want: map[string]string{"env": "prod"},
+		},
+		{
+			name: "value contains equals",
+			raw:  []string{"owner=team=platform"},
+			want: map[string]string{"owner": "team=platform"},
+		},
+		{
+			name:    "missing equals",
+			raw:     []string{"env"},
+			wantErr: true,
+		},
+		{
+			name:    "empty key",
+			raw:     []string{"=prod"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTags(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTags(%v) = nil error, want error", tt.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTags(%v) returned unexpected error: %v", tt.raw, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseTags(%v) = %v, want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	"github.com/rancher/kontainer-engine/drivers/options"
+	"github.com/rancher/kontainer-engine/types"
+)
+
+// CloudStack's documented cloud-init user-data size limits: 32KB for
+// deployments that haven't enabled the extended user-data feature, 1MB
+// for those that have (tracked here as AcsSettings.UserDataLarge, since
+// the go-cloudstack client has no call to discover it at runtime).
+const (
+	unregisteredUserDataLimit = 32 * 1024
+	registeredUserDataLimit   = 1024 * 1024
+)
+
+// userDataVars are the template variables available to operator-supplied
+// cloud-init user-data, letting a single template bootstrap every role
+// (e.g. have workers `rke2 agent` against APIServerEndpoint with
+// JoinToken, and control-plane nodes `rke2 server`).
+type userDataVars struct {
+	ClusterName       string
+	Role              NodeRole
+	NodeIndex         int64
+	ZoneID            string
+	JoinToken         string
+	APIServerEndpoint string
+}
+
+func parseUserDataRoleOverrides(raw string) (map[NodeRole]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	var byRole map[string]string
+	if err := json.Unmarshal([]byte(raw), &byRole); err != nil {
+		return nil, fmt.Errorf("parsing user-data-role-overrides: %v", err)
+	}
+
+	overrides := make(map[NodeRole]string, len(byRole))
+	for role, content := range byRole {
+		overrides[NodeRole(role)] = content
+	}
+	return overrides, nil
+}
+
+// generateJoinToken produces a random token for node bootstrap scripts to
+// join the cluster with, used when the operator doesn't supply one via
+// the join-token flag. It's generated once in Create and persisted in
+// AcsSettings so later SetClusterSize scale-ups reuse the same value.
+func generateJoinToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating join token: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// baseUserData resolves the un-templated cloud-init contents for role,
+// preferring a role-specific override, then the shared user-data-path
+// file, then the shared inline user-data-contents.
+func (c *AcsSettings) baseUserData(role NodeRole) (string, error) {
+	if override, ok := c.UserDataRoleOverrides[role]; ok && override != "" {
+		return override, nil
+	}
+
+	return resolvePathOrInline(c.UserDataPath, c.UserData)
+}
+
+// resolvePathOrInline reads path if set, otherwise returns inline
+// as-is. Several driver flags accept either a file to read (-path) or a
+// literal value (-contents) for the same setting; this is shared by all
+// of them.
+func resolvePathOrInline(path, inline string) (string, error) {
+	if path == "" {
+		return inline, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", path, err)
+	}
+	return string(contents), nil
+}
+
+// renderUserData resolves, templates and base64-encodes the cloud-init
+// payload for a single node, validating it against CloudStack's size
+// limit. It returns "" if the role has no user-data configured.
+func (c *AcsSettings) renderUserData(vars userDataVars) (string, error) {
+	raw, err := c.baseUserData(vars.Role)
+	if err != nil {
+		return "", err
+	}
+	if raw == "" {
+		return "", nil
+	}
+
+	tmpl, err := template.New("user-data").Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("parsing user-data template for role %s: %v", vars.Role, err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, vars); err != nil {
+		return "", fmt.Errorf("rendering user-data template for role %s: %v", vars.Role, err)
+	}
+
+	limit := unregisteredUserDataLimit
+	if c.UserDataLarge {
+		limit = registeredUserDataLimit
+	}
+	if rendered.Len() > limit {
+		return "", fmt.Errorf("user-data for role %s is %d bytes, which exceeds the %d byte limit (set user-data-large if this CloudStack deployment has the extended limit enabled)", vars.Role, rendered.Len(), limit)
+	}
+
+	return base64.StdEncoding.EncodeToString(rendered.Bytes()), nil
+}
+
+func getUserDataFromOpts(driverOptions *types.DriverOptions) (AcsSettings, error) {
+	overrides, err := parseUserDataRoleOverrides(options.GetValueFromDriverOptions(driverOptions, types.StringType, "user-data-role-overrides").(string))
+	if err != nil {
+		return AcsSettings{}, err
+	}
+
+	return AcsSettings{
+		UserData:              options.GetValueFromDriverOptions(driverOptions, types.StringType, "user-data-contents", "UserData").(string),
+		UserDataPath:          options.GetValueFromDriverOptions(driverOptions, types.StringType, "user-data-path").(string),
+		UserDataRoleOverrides: overrides,
+		UserDataLarge:         options.GetValueFromDriverOptions(driverOptions, types.BoolType, "user-data-large").(bool),
+		JoinToken:             options.GetValueFromDriverOptions(driverOptions, types.StringType, "join-token").(string),
+		APIServerEndpoint:     options.GetValueFromDriverOptions(driverOptions, types.StringType, "api-server-endpoint").(string),
+	}, nil
+}
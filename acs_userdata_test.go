@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestRenderUserDataWithinLimit(t *testing.T) {
+	c := &AcsSettings{UserData: "#cloud-config\nhostname: {{.ClusterName}}-{{.Role}}-{{.NodeIndex}}\n"}
+
+	got, err := c.renderUserData(userDataVars{ClusterName: "mycluster", Role: RoleWorker, NodeIndex: 2})
+	if err != nil {
+		t.Fatalf("renderUserData returned unexpected error: %v", err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(got)
+	if err != nil {
+		t.Fatalf("renderUserData didn't return valid base64: %v", err)
+	}
+	if !strings.Contains(string(decoded), "mycluster-worker-2") {
+		t.Fatalf("rendered user-data = %q, want it to contain the templated cluster/role/index", decoded)
+	}
+}
+
+func TestRenderUserDataExceedsLimit(t *testing.T) {
+	c := &AcsSettings{UserData: strings.Repeat("a", unregisteredUserDataLimit+1)}
+
+	if _, err := c.renderUserData(userDataVars{Role: RoleWorker}); err == nil {
+		t.Fatal("renderUserData with oversized payload returned no error, want one")
+	}
+}
+
+func TestRenderUserDataLargeLimitAllowsBiggerPayload(t *testing.T) {
+	c := &AcsSettings{
+		UserData:      strings.Repeat("a", unregisteredUserDataLimit+1),
+		UserDataLarge: true,
+	}
+
+	if _, err := c.renderUserData(userDataVars{Role: RoleWorker}); err != nil {
+		t.Fatalf("renderUserData with user-data-large set returned unexpected error: %v", err)
+	}
+}
+
+func TestRenderUserDataEmptyReturnsEmptyString(t *testing.T) {
+	c := &AcsSettings{}
+
+	got, err := c.renderUserData(userDataVars{Role: RoleWorker})
+	if err != nil {
+		t.Fatalf("renderUserData returned unexpected error: %v", err)
+	}
+	if got != "" {
+		t.Fatalf("renderUserData with no user-data configured = %q, want empty string", got)
+	}
+}
@@ -0,0 +1,122 @@
+// Package acsjob polls CloudStack asynchronous jobs to completion.
+//
+// DeployVirtualMachine, DestroyVirtualMachine, ScaleVirtualMachine,
+// CreateNetwork and most other mutating CloudStack calls only enqueue
+// work and hand back a job ID; the actual result is only known once the
+// job leaves the pending state. Waiter centralizes that polling so every
+// caller in the driver gets the same timeout/backoff and error reporting.
+package acsjob
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/xanzy/go-cloudstack/cloudstack"
+)
+
+// DefaultTimeout is how long Wait polls before giving up when the caller
+// doesn't specify one.
+const DefaultTimeout = 10 * time.Minute
+
+// DefaultInterval is the delay between poll attempts when the caller
+// doesn't specify one.
+const DefaultInterval = 5 * time.Second
+
+// Pending/success/failure job status codes, as returned by CloudStack's
+// queryAsyncJobResult in the "jobstatus" field.
+const (
+	statusPending = 0
+	statusSuccess = 1
+	statusFailure = 2
+)
+
+// Error describes a CloudStack job that reached the failure status,
+// carrying the errorcode/errortext CloudStack embedded in the job result
+// so callers can surface something more useful than "job failed".
+type Error struct {
+	JobID string
+	Code  int
+	Text  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("cloudstack job %s failed (code %d): %s", e.JobID, e.Code, e.Text)
+}
+
+// Waiter polls a single CloudStack job until it completes, fails or times
+// out.
+type Waiter struct {
+	CS       *cloudstack.CloudStackClient
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+// New returns a Waiter configured with the package defaults. Callers can
+// override Timeout/Interval on the returned value before calling Wait.
+func New(cs *cloudstack.CloudStackClient) *Waiter {
+	return &Waiter{
+		CS:       cs,
+		Timeout:  DefaultTimeout,
+		Interval: DefaultInterval,
+	}
+}
+
+// Wait blocks until the job identified by jobID leaves the pending state.
+// An empty jobID is treated as "nothing to wait for" and returns immediately,
+// since some CloudStack calls complete synchronously. On success it
+// returns the raw "jobresult" payload so callers that need fields beyond
+// what the originating *Params/*Response pair exposes can decode it
+// themselves.
+func (w *Waiter) Wait(jobID string) (json.RawMessage, error) {
+	if jobID == "" {
+		return nil, nil
+	}
+
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	interval := w.Interval
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		p := w.CS.Asyncjob.NewQueryAsyncJobResultParams(jobID)
+		result, err := w.CS.Asyncjob.QueryAsyncJobResult(p)
+		if err != nil {
+			return nil, fmt.Errorf("querying cloudstack job %s: %v", jobID, err)
+		}
+
+		switch result.Jobstatus {
+		case statusSuccess:
+			return result.Jobresult, nil
+		case statusFailure:
+			return nil, &Error{
+				JobID: jobID,
+				Code:  result.Jobresultcode,
+				Text:  extractErrorText(result.Jobresult),
+			}
+		default:
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("timed out after %s waiting for cloudstack job %s", timeout, jobID)
+			}
+			time.Sleep(interval)
+		}
+	}
+}
+
+// extractErrorText pulls CloudStack's "errortext" out of a failed job's
+// raw result payload, falling back to the raw payload when it doesn't
+// match the expected shape.
+func extractErrorText(raw json.RawMessage) string {
+	var payload struct {
+		Errortext string `json:"errortext"`
+	}
+	if err := json.Unmarshal(raw, &payload); err == nil && payload.Errortext != "" {
+		return payload.Errortext
+	}
+	return string(raw)
+}